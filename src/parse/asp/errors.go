@@ -2,10 +2,13 @@ package asp
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -34,13 +37,78 @@ func (err errDeferParse) Error() string {
 }
 
 // RequiresSubinclude returns true if the error requires another target to be built, along with the target in question.
+// For a JoinErrors result it walks the leaves in order and returns the label of the first one
+// that requires a subinclude; labels required by later leaves are not returned.
 func RequiresSubinclude(err error) (bool, core.BuildLabel) {
-	if dp, ok := err.(errDeferParse); ok {
+	if je, ok := err.(*joinedError); ok {
+		for _, sub := range je.errs {
+			if ok, label := RequiresSubinclude(sub); ok {
+				return true, label
+			}
+		}
+		return false, core.BuildLabel{}
+	}
+	var dp errDeferParse
+	if errors.As(err, &dp) {
 		return true, dp.Label
 	}
 	return false, core.BuildLabel{}
 }
 
+// joinedError carries several independent errors, each with its own frame chain, e.g. from
+// parsing multiple packages concurrently where more than one fails.
+type joinedError struct {
+	errs []error
+}
+
+// JoinErrors combines multiple independent errors into a single error value, so callers like
+// RequiresSubinclude can inspect every leaf instead of only the first failure. The rendered
+// message shows each leaf as its own "Traceback (i of N)" block.
+func JoinErrors(errs ...error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	if len(nonNil) == 0 {
+		return nil
+	} else if len(nonNil) == 1 {
+		return nonNil[0]
+	}
+	return &joinedError{errs: nonNil}
+}
+
+// flattenJoined expands a JoinErrors result into its leaves, recursing through any nested
+// joins. A non-joined error is returned as a single-element slice.
+func flattenJoined(err error) []error {
+	je, ok := err.(*joinedError)
+	if !ok {
+		return []error{err}
+	}
+	var leaves []error
+	for _, sub := range je.errs {
+		leaves = append(leaves, flattenJoined(sub)...)
+	}
+	return leaves
+}
+
+// Error implements the builtin error interface.
+func (je *joinedError) Error() string {
+	leaves := flattenJoined(je)
+	parts := make([]string, len(leaves))
+	for i, err := range leaves {
+		parts[i] = fmt.Sprintf("Traceback (%d of %d):\n%s", i+1, len(leaves), err.Error())
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// Unwrap returns the errors that were joined, so errors.Is / errors.As can inspect each of
+// them (Go's errors package has supported multi-error Unwrap since 1.20).
+func (je *joinedError) Unwrap() []error {
+	return je.errs
+}
+
 // An errorStack is an error that carries an internal stack trace.
 type errorStack struct {
 	// From top down, i.e. Stack[0] is the innermost function in the call stack.
@@ -48,8 +116,64 @@ type errorStack struct {
 	// Readers that correspond to each level in the stack trace.
 	// Each may be nil but this will always have the same length as Stack.
 	Readers []io.ReadSeeker
+	// Ends holds the end position for each level in Stack, for frames that cover a range
+	// rather than a single point (see AddStackFrameRange). Zero-valued when unknown, in which
+	// case the frame is treated as a single-character point at its Stack position.
+	Ends []Position
 	// The original error that was encountered.
 	err error
+	// goFrames holds the underlying Go call stack at the point the error was first raised,
+	// captured only when debugTraceback is enabled. Nil otherwise.
+	goFrames []Frame
+}
+
+// debugTraceback controls whether errorStack reports the underlying Go call stack
+// (captured via runtime.Callers) as a separate block after the usual BUILD-file frames; the
+// two are not interleaved frame by frame. It's off by default
+// since capturing it has a real cost and it's only useful to plugin authors and please
+// maintainers debugging a crash inside an asp builtin.
+var debugTraceback = os.Getenv("PLZ_DEBUG_TRACEBACK") != ""
+
+// SetDebugTraceback turns Go call-stack reporting on or off, for the
+// `--debug_traceback` flag. It overrides whatever PLZ_DEBUG_TRACEBACK was set to.
+func SetDebugTraceback(enabled bool) {
+	debugTraceback = enabled
+}
+
+// captureGoFrames records the current Go call stack, with this function's own frame and any
+// runtime / deferred-call glue stripped out.
+func captureGoFrames() []Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	callerFrames := runtime.CallersFrames(pcs[:n])
+	var frames []Frame
+	for {
+		f, more := callerFrames.Next()
+		if !isGoRuntimeGlue(f.Function) {
+			frames = append(frames, Frame{Filename: f.File, Line: f.Line, FuncName: f.Function})
+		}
+		if !more {
+			break
+		}
+	}
+	return frames
+}
+
+// isGoRuntimeGlue reports whether fn is a runtime function, e.g. "runtime.gopanic", or looks
+// like a compiler-generated closure such as one for a defer statement. Any name containing
+// ".func" is treated as such a closure, including named functions like "pkg.funcName".
+func isGoRuntimeGlue(fn string) bool {
+	return strings.HasPrefix(fn, "runtime.") || strings.HasSuffix(fn, ".func1") || strings.Contains(fn, ".func")
+}
+
+// Frame describes a single level of an errorStack's trace, in a form that's convenient
+// for tools to consume without re-parsing the human-readable traceback.
+type Frame struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	FuncName string `json:"funcName,omitempty"`
+	Snippet  string `json:"snippet,omitempty"`
 }
 
 // fail panics on lex/parse errors in a file.
@@ -58,8 +182,42 @@ func fail(pos Position, message string, args ...interface{}) {
 	panic(AddStackFrame(pos, fmt.Errorf(message, args...)))
 }
 
+// failRange is like fail but for errors that span more than one character, e.g. a bad call
+// expression, so the rendered error underlines the whole offending token rather than just
+// its first one.
+func failRange(rng Range, message string, args ...interface{}) {
+	panic(AddStackFrameRange(rng, fmt.Errorf(message, args...)))
+}
+
+// WrapError wraps err as a typed asp error without attaching a stack frame. It is for callers
+// that don't have a parser position to hand (e.g. a missing subinclude discovered while
+// resolving a target), but still want the result to support errors.Is/errors.As and
+// RenderErrorJSON like any other asp error. An errDeferParse, or an error that is already an
+// errorStack, is returned unchanged.
+func WrapError(err error) error {
+	if err == nil {
+		return nil
+	} else if _, ok := err.(*errorStack); ok {
+		return err // Already wrapped.
+	} else if _, ok := err.(errDeferParse); ok {
+		return err // Does not need stack information.
+	}
+	stack := &errorStack{err: err}
+	if debugTraceback {
+		stack.goFrames = captureGoFrames()
+	}
+	return stack
+}
+
 // AddStackFrame adds a new stack frame to the given errorStack, or wraps an existing error if not.
 func AddStackFrame(pos Position, err interface{}) error {
+	return AddStackFrameRange(Range{Start: pos, End: pos}, err)
+}
+
+// AddStackFrameRange behaves like AddStackFrame but records the full extent of the offending
+// token or expression, so the eventual error message can underline more than just its opening
+// character.
+func AddStackFrameRange(rng Range, err interface{}) error {
 	stack, ok := err.(*errorStack)
 	if !ok {
 		if dp, ok := err.(errDeferParse); ok {
@@ -69,10 +227,14 @@ func AddStackFrame(pos Position, err interface{}) error {
 		} else {
 			stack = &errorStack{err: fmt.Errorf("%s", err)}
 		}
-	} else if n := len(stack.Stack) - 1; n > 0 && stack.Stack[n].Filename == pos.Filename && stack.Stack[n].Line == pos.Line {
+		if debugTraceback {
+			stack.goFrames = captureGoFrames()
+		}
+	} else if n := len(stack.Stack) - 1; n > 0 && stack.Stack[n].Filename == rng.Start.Filename && stack.Stack[n].Line == rng.Start.Line {
 		return stack // Don't duplicate the same line multiple times. Often happens since one line can have multiple expressions.
 	}
-	stack.Stack = append(stack.Stack, pos)
+	stack.Stack = append(stack.Stack, rng.Start)
+	stack.Ends = append(stack.Ends, rng.End)
 	stack.Readers = append(stack.Readers, nil)
 	return stack
 }
@@ -85,12 +247,301 @@ func AddReader(err error, r io.ReadSeeker) error {
 	return err
 }
 
+// RenderErrorJSON renders err as a machine-readable JSON diagnostic, so tools and IDE
+// integrations can consume parse/exec failures without scraping the human-readable traceback.
+// Errors that don't carry an asp stack trace are rendered as a bare message.
+//
+// Deprecated: prefer the "json" ErrorFormatter returned by Formatter, which this now delegates to.
+func RenderErrorJSON(err error) string {
+	return jsonFormatter{}.Format(err)
+}
+
+// A ColorScheme defines the escape sequences used to highlight the different parts of an
+// error message. The zero value renders no colour at all, which is what a non-terminal or
+// a NO_COLOR (see https://no-color.org) request should use.
+type ColorScheme struct {
+	Reset, BoldRed, BoldWhite, Red, Yellow, White, Grey string
+}
+
+// plainColorScheme is the colourless scheme, used for non-terminals and NO_COLOR.
+var plainColorScheme = ColorScheme{}
+
+// ansiColorScheme is the scheme historically hardcoded into this file.
+var ansiColorScheme = ColorScheme{
+	Reset: reset, BoldRed: boldRed, BoldWhite: boldWhite, Red: red, Yellow: yellow, White: white, Grey: grey,
+}
+
+// currentColorScheme picks the ColorScheme appropriate for the current output, honouring
+// NO_COLOR in addition to the existing isatty check.
+func currentColorScheme() ColorScheme {
+	if !cli.StdErrIsATerminal || os.Getenv("NO_COLOR") != "" {
+		return plainColorScheme
+	}
+	return ansiColorScheme
+}
+
+// colour reports whether scheme represents an actual colour scheme rather than plain text.
+func (scheme ColorScheme) colour() bool {
+	return scheme != plainColorScheme
+}
+
+// An ErrorFormatter renders an asp error (or any other error) as a complete diagnostic.
+// Implementations are selected by name via Formatter, e.g. for `plz build --error_format=sarif`.
+type ErrorFormatter interface {
+	// Format renders err as a complete diagnostic message in this formatter's output format.
+	Format(err error) string
+}
+
+// Formatter returns the ErrorFormatter registered under name, or nil with ok false if name
+// isn't recognised. Supported names are "text" (the default, human-readable traceback),
+// "ansi" (as "text" but always coloured, regardless of terminal detection), "json" and "sarif".
+func Formatter(name string) (f ErrorFormatter, ok bool) {
+	switch name {
+	case "", "text":
+		return textFormatter{Scheme: currentColorScheme()}, true
+	case "ansi":
+		return textFormatter{Scheme: ansiColorScheme}, true
+	case "json":
+		return jsonFormatter{}, true
+	case "sarif":
+		return sarifFormatter{}, true
+	}
+	return nil, false
+}
+
+// textFormatter renders the traditional human-readable traceback, in the given ColorScheme.
+type textFormatter struct {
+	Scheme ColorScheme
+}
+
+// Format implements ErrorFormatter. A JoinErrors result is rendered as one "Traceback (i of N)"
+// block per leaf, each formatted independently in the same ColorScheme.
+func (tf textFormatter) Format(err error) string {
+	if leaves := flattenJoined(err); len(leaves) > 1 {
+		parts := make([]string, len(leaves))
+		for i, leaf := range leaves {
+			parts[i] = fmt.Sprintf("Traceback (%d of %d):\n%s", i+1, len(leaves), tf.Format(leaf))
+		}
+		return strings.Join(parts, "\n\n")
+	}
+	var stack *errorStack
+	if !errors.As(err, &stack) {
+		return err.Error()
+	}
+	msg := stack.errorMessage(tf.Scheme)
+	if len(stack.Stack) > 1 {
+		msg += "\n" + stack.stackTrace(tf.Scheme)
+	}
+	if debugTraceback && len(stack.goFrames) > 0 {
+		msg += "\n" + stack.goTraceback(tf.Scheme)
+	}
+	return msg
+}
+
+// jsonFormatter renders errors as a single-line JSON diagnostic; see RenderErrorJSON.
+type jsonFormatter struct{}
+
+// jsonError is the JSON-serialisable representation of a single error leaf.
+type jsonError struct {
+	Message  string  `json:"message"`
+	Filename string  `json:"filename,omitempty"`
+	Line     int     `json:"line,omitempty"`
+	Column   int     `json:"column,omitempty"`
+	Frames   []Frame `json:"frames,omitempty"`
+	GoFrames []Frame `json:"goFrames,omitempty"`
+}
+
+// buildJSONError renders a single (non-joined) error as a jsonError.
+func buildJSONError(err error) jsonError {
+	je := jsonError{Message: err.Error()}
+	var stack *errorStack
+	if errors.As(err, &stack) {
+		pos := stack.Position()
+		je.Message = stack.ShortError()
+		je.Filename = pos.Filename
+		je.Line = pos.Line
+		je.Column = pos.Column
+		je.Frames = stack.Frames()
+		je.GoFrames = stack.goFrames
+	}
+	return je
+}
+
+// Format implements ErrorFormatter. A JoinErrors result is rendered as a JSON array of its
+// leaves rather than a single object, so tools don't have to special-case it.
+func (jsonFormatter) Format(err error) string {
+	leaves := flattenJoined(err)
+	var v interface{}
+	if len(leaves) == 1 {
+		v = buildJSONError(leaves[0])
+	} else {
+		errs := make([]jsonError, len(leaves))
+		for i, e := range leaves {
+			errs[i] = buildJSONError(e)
+		}
+		v = errs
+	}
+	b, marshalErr := json.Marshal(v)
+	if marshalErr != nil {
+		return fmt.Sprintf(`{"message": %q}`, err.Error())
+	}
+	return string(b)
+}
+
+// sarifFormatter renders errors as a SARIF 2.1.0 log, so please's BUILD-file diagnostics can
+// be consumed by GitHub code scanning and IDE problem matchers that understand SARIF.
+type sarifFormatter struct{}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifDriver struct {
+	Name string `json:"name"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+// buildSarifResult renders a single (non-joined) error as a sarifResult.
+func buildSarifResult(err error) sarifResult {
+	result := sarifResult{
+		RuleID:  "please/parse-error",
+		Level:   "error",
+		Message: sarifMessage{Text: err.Error()},
+	}
+	var stack *errorStack
+	if errors.As(err, &stack) {
+		result.Message.Text = stack.ShortError()
+		// A WrapError-produced error has no frame, and so no position to report; a location
+		// with an empty uri and a zero (pre-SARIF, 1-based) startLine is invalid SARIF.
+		if len(stack.Stack) > 0 {
+			pos := stack.Position()
+			result.Locations = []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: pos.Filename},
+					Region:           sarifRegion{StartLine: pos.Line, StartColumn: pos.Column},
+				},
+			}}
+		}
+	}
+	return result
+}
+
+// Format implements ErrorFormatter. A JoinErrors result contributes one SARIF result per leaf.
+func (sarifFormatter) Format(err error) string {
+	leaves := flattenJoined(err)
+	results := make([]sarifResult, len(leaves))
+	for i, e := range leaves {
+		results[i] = buildSarifResult(e)
+	}
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool:    sarifTool{Driver: sarifDriver{Name: "please"}},
+			Results: results,
+		}},
+	}
+	b, marshalErr := json.Marshal(log)
+	if marshalErr != nil {
+		return fmt.Sprintf(`{"message": %q}`, err.Error())
+	}
+	return string(b)
+}
+
 // Error implements the builtin error interface.
 func (stack *errorStack) Error() string {
-	if len(stack.Stack) > 1 {
-		return stack.errorMessage() + "\n" + stack.stackTrace()
+	return textFormatter{Scheme: currentColorScheme()}.Format(stack)
+}
+
+// goTraceback renders the underlying Go call stack captured at the point this error was
+// first raised, for --debug_traceback / PLZ_DEBUG_TRACEBACK. It's shown as a separate block
+// below the usual BUILD-file traceback rather than instead of it, since plugin authors
+// generally want both; the Go frames are not interleaved with the BUILD-file frames.
+func (stack *errorStack) goTraceback(scheme ColorScheme) string {
+	lines := make([]string, len(stack.goFrames))
+	for i, f := range stack.goFrames {
+		lines[i] = fmt.Sprintf("    %s\n        %s:%d", f.FuncName, f.Filename, f.Line)
+	}
+	msg := "Go call stack:\n"
+	if scheme.colour() {
+		msg = scheme.BoldWhite + msg + scheme.Reset
 	}
-	return stack.errorMessage()
+	return msg + strings.Join(lines, "\n")
+}
+
+// Unwrap implements the interface assumed by errors.Is / errors.As, returning the underlying
+// error that the stack trace was attached to.
+func (stack *errorStack) Unwrap() error {
+	return stack.err
+}
+
+// Position returns the outermost source position at which this error was raised, i.e. the
+// one shown as the primary location in Error(). Returns the zero Position for an error that
+// was never attached to a frame, e.g. one produced by WrapError.
+func (stack *errorStack) Position() Position {
+	if len(stack.Stack) == 0 {
+		return Position{}
+	}
+	return stack.Stack[len(stack.Stack)-1]
+}
+
+// Frames returns the typed call stack for this error, in the same order as Stack
+// (innermost first), with a source snippet recovered for each frame where possible.
+func (stack *errorStack) Frames() []Frame {
+	frames := make([]Frame, len(stack.Stack))
+	for i, pos := range stack.Stack {
+		_, snippetLines, _ := stack.readLine(stack.Readers[i], Range{Start: pos})
+		snippet := ""
+		if len(snippetLines) > 0 {
+			snippet = snippetLines[0]
+		}
+		frames[i] = Frame{
+			Filename: pos.Filename,
+			Line:     pos.Line,
+			Column:   pos.Column,
+			Snippet:  snippet,
+		}
+	}
+	return frames
 }
 
 // ShortError returns an abbreviated message with jsut what immediately went wrong.
@@ -99,7 +550,7 @@ func (stack *errorStack) ShortError() string {
 }
 
 // stackTrace returns the lines of stacktrace from the error.
-func (stack *errorStack) stackTrace() string {
+func (stack *errorStack) stackTrace(scheme ColorScheme) string {
 	ret := make([]string, len(stack.Stack))
 	filenames := make([]string, len(stack.Stack))
 	lines := make([]string, len(stack.Stack))
@@ -119,25 +570,29 @@ func (stack *errorStack) stackTrace() string {
 		if frame.Line == lastLine && frame.Filename == lastFile {
 			continue // Don't show the same line twice.
 		}
-		_, line, _ := stack.readLine(stack.Readers[i], frame.Line-1)
+		_, frameLines, _ := stack.readLine(stack.Readers[i], Range{Start: frame})
+		line := ""
+		if len(frameLines) > 0 {
+			line = frameLines[0]
+		}
 		if line == "" {
 			line = "<source unavailable>"
-			if cli.StdErrIsATerminal {
-				line = grey + line + reset
+			if scheme.colour() {
+				line = scheme.Grey + line + scheme.Reset
 			}
 		}
 		s := fmt.Sprintf("%s:%s:%s:", filenames[i], lines[i], cols[i])
-		if !cli.StdErrIsATerminal {
+		if !scheme.colour() {
 			ret[i] = fmt.Sprintf("%s   %s", s, line)
 		} else {
-			ret[i] = fmt.Sprintf("%s%s%s   %s", yellow, s, reset, line)
+			ret[i] = fmt.Sprintf("%s%s%s   %s", scheme.Yellow, s, scheme.Reset, line)
 		}
 		lastLine = frame.Line
 		lastFile = frame.Filename
 	}
 	msg := "Traceback:\n"
-	if cli.StdErrIsATerminal {
-		msg = boldWhite + msg + reset
+	if scheme.colour() {
+		msg = scheme.BoldWhite + msg + scheme.Reset
 	}
 	return msg + strings.Join(ret, "\n")
 }
@@ -155,67 +610,161 @@ func (stack *errorStack) equaliseLengths(sl []string) {
 	}
 }
 
+// A Range describes a span of source positions, e.g. the full extent of an offending token
+// or expression, rather than just the single character a Position points at.
+type Range struct {
+	Start, End Position
+}
+
 // errorMessage returns the first part of the error message (i.e. the main message & file context)
-func (stack *errorStack) errorMessage() string {
+func (stack *errorStack) errorMessage(scheme ColorScheme) string {
+	// An error with no frames at all (e.g. from WrapError) has no source context to show.
+	if len(stack.Stack) == 0 {
+		return stack.err.Error()
+	}
 	// Take the outermost call in the stack since that is usually the most relevant to people.
 	n := len(stack.Stack) - 1
-	frame := stack.Stack[n]
-	if before, line, after := stack.readLine(stack.Readers[n], frame.Line-1); line != "" || before != "" || after != "" {
-		charsBefore := frame.Column - 1
-		if charsBefore < 0 { // strings.Repeat panics if negative
-			charsBefore = 0
-		} else if charsBefore == len(line) {
-			line = line + "  "
-		} else if charsBefore > len(line) {
-			return stack.Error() // probably something's gone wrong and we're on totally the wrong line.
+	rng := Range{Start: stack.Stack[n], End: stack.Stack[n]}
+	if n < len(stack.Ends) && stack.Ends[n].Line != 0 {
+		rng.End = stack.Ends[n]
+	}
+	before, lines, after := stack.readLine(stack.Readers[n], rng)
+	if len(lines) == 0 {
+		return stack.err.Error()
+	}
+	if len(lines) == 1 {
+		return stack.errorMessageLine(before, lines[0], after, rng, scheme)
+	}
+	return stack.errorMessageRange(before, lines, after, rng, scheme)
+}
+
+// errorMessageLine renders a single-line Range, underlining the whole span with one or more '^'.
+func (stack *errorStack) errorMessageLine(before, line, after string, rng Range, scheme ColorScheme) string {
+	start := rng.Start
+	charsBefore := start.Column - 1
+	if charsBefore < 0 { // strings.Repeat panics if negative
+		charsBefore = 0
+	} else if charsBefore > len(line) {
+		return stack.err.Error() // probably something's gone wrong and we're on totally the wrong line.
+	} else if charsBefore == len(line) {
+		line = line + "  "
+	}
+	width := 1
+	if rng.End.Line == start.Line && rng.End.Column > start.Column {
+		width = rng.End.Column - start.Column
+	}
+	if charsBefore+width > len(line) {
+		width = maxInt(1, len(line)-charsBefore)
+	}
+	spaces := strings.Repeat(" ", charsBefore)
+	carets := strings.Repeat("^", width)
+	if !scheme.colour() {
+		return fmt.Sprintf("%s:%d:%d: error: %s\n%s\n%s\n%s%s\n%s\n",
+			start.Filename, start.Line, start.Column, stack.err, before, line, spaces, carets, after)
+	}
+	// Add colour hints as well. It's a bit weird to add them here where we don't know
+	// how this is going to be printed, but not obvious how to solve well.
+	coloured := scheme.White + line[:charsBefore] + scheme.Red + line[charsBefore:charsBefore+width] + scheme.White + line[charsBefore+width:] + scheme.Reset
+	return fmt.Sprintf("%s%s%s:%s%d%s:%s%d%s: %serror:%s %s%s%s\n%s%s\n%s\n%s%s\n%s%s%s\n",
+		scheme.BoldWhite, start.Filename, scheme.Reset,
+		scheme.BoldWhite, start.Line, scheme.Reset,
+		scheme.BoldWhite, start.Column, scheme.Reset,
+		scheme.BoldRed, scheme.Reset,
+		scheme.BoldWhite, stack.err, scheme.Reset,
+		scheme.Grey, before,
+		coloured,
+		scheme.Red, carets,
+		scheme.Grey, after, scheme.Reset,
+	)
+}
+
+// errorMessageRange renders a Range spanning more than one line, underlining each line fully
+// except where the range starts or ends partway through it.
+func (stack *errorStack) errorMessageRange(before string, lines []string, after string, rng Range, scheme ColorScheme) string {
+	start := rng.Start
+	header := fmt.Sprintf("%s:%d:%d: error: %s", start.Filename, start.Line, start.Column, stack.err)
+	if scheme.colour() {
+		header = fmt.Sprintf("%s%s%s:%s%d%s:%s%d%s: %serror:%s %s%s%s",
+			scheme.BoldWhite, start.Filename, scheme.Reset,
+			scheme.BoldWhite, start.Line, scheme.Reset,
+			scheme.BoldWhite, start.Column, scheme.Reset,
+			scheme.BoldRed, scheme.Reset,
+			scheme.BoldWhite, stack.err, scheme.Reset)
+	}
+	parts := []string{header}
+	if before != "" {
+		parts = append(parts, before)
+	}
+	for i, line := range lines {
+		from := 0
+		if i == 0 {
+			from = maxInt(0, minInt(start.Column-1, len(line)))
 		}
-		spaces := strings.Repeat(" ", charsBefore)
-		if !cli.StdErrIsATerminal {
-			return fmt.Sprintf("%s:%d:%d: error: %s\n%s\n%s\n%s^\n%s\n",
-				frame.Filename, frame.Line, frame.Column, stack.err, before, line, spaces, after)
+		to := len(line)
+		if i == len(lines)-1 {
+			to = maxInt(from, minInt(rng.End.Column-1, len(line)))
 		}
-		// Add colour hints as well. It's a bit weird to add them here where we don't know
-		// how this is going to be printed, but not obvious how to solve well.
-		return fmt.Sprintf("%s%s%s:%s%d%s:%s%d%s: %serror:%s %s%s%s\n%s%s\n%s%s%s%c%s%s\n%s^\n%s%s%s\n",
-			boldWhite, frame.Filename, reset,
-			boldWhite, frame.Line, reset,
-			boldWhite, frame.Column, reset,
-			boldRed, reset,
-			boldWhite, stack.err, reset,
-			grey, before,
-			white, line[:charsBefore], red, line[charsBefore], white, line[charsBefore+1:],
-			spaces,
-			grey, after, reset,
-		)
+		underline := strings.Repeat(" ", from) + strings.Repeat("^", maxInt(1, to-from))
+		if scheme.colour() {
+			underline = scheme.Red + underline + scheme.Reset
+		}
+		parts = append(parts, line, underline)
 	}
-	return stack.err.Error()
+	if after != "" {
+		parts = append(parts, after)
+	}
+	return strings.Join(parts, "\n") + "\n"
 }
 
-// readLine reads a particular line of a reader plus some context.
-func (stack *errorStack) readLine(r io.ReadSeeker, line int) (string, string, string) {
+// maxInt and minInt exist because this predates Go's builtin max/min.
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readLine reads the line(s) spanned by rng from r, plus a line of context before and after.
+// When rng.End is the same as rng.Start (or unset) a single line is returned.
+func (stack *errorStack) readLine(r io.ReadSeeker, rng Range) (before string, lines []string, after string) {
 	// The reader for any level of the stack is allowed to be nil.
 	if r == nil {
-		return "", "", ""
+		return "", nil, ""
 	}
 	r.Seek(0, io.SeekStart)
 	// This isn't 100% efficient but who cares really.
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
-		return "", "", ""
+		return "", nil, ""
+	}
+	all := bytes.Split(b, []byte{'\n'})
+	startLine := rng.Start.Line - 1
+	if startLine < 0 || startLine >= len(all) {
+		return "", nil, ""
+	}
+	endLine := rng.End.Line - 1
+	if endLine < startLine {
+		endLine = startLine
+	} else if endLine >= len(all) {
+		endLine = len(all) - 1
 	}
-	lines := bytes.Split(b, []byte{'\n'})
-	if len(lines) <= line {
-		return "", "", ""
+	if startLine > 0 {
+		before = string(all[startLine-1])
 	}
-	before := ""
-	if line > 0 {
-		before = string(lines[line-1])
+	for i := startLine; i <= endLine; i++ {
+		lines = append(lines, string(all[i]))
 	}
-	after := ""
-	if line < len(lines)-1 {
-		after = string(lines[line+1])
+	if endLine < len(all)-1 {
+		after = string(all[endLine+1])
 	}
-	return before, string(lines[line]), after
+	return before, lines, after
 }
 
 // AddReader adds an io.Reader into this error where appropriate.
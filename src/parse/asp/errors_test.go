@@ -0,0 +1,238 @@
+package asp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestWrapErrorNoStack ensures an error with no attached frames (as produced by WrapError for
+// e.g. a missing subinclude) can still be
+// rendered by every code path that otherwise assumes at least one frame.
+func TestWrapErrorNoStack(t *testing.T) {
+	wrapped := WrapError(errTest("something went missing"))
+
+	if msg := wrapped.Error(); msg != "something went missing" {
+		t.Errorf("Error() = %q, want %q", msg, "something went missing")
+	}
+	if json := RenderErrorJSON(wrapped); !strings.Contains(json, "something went missing") {
+		t.Errorf("RenderErrorJSON() = %q, want it to contain the message", json)
+	}
+	for _, name := range []string{"text", "ansi", "json", "sarif"} {
+		f, ok := Formatter(name)
+		if !ok {
+			t.Fatalf("Formatter(%q) not found", name)
+		}
+		if out := f.Format(wrapped); !strings.Contains(out, "something went missing") {
+			t.Errorf("Formatter(%q).Format() = %q, want it to contain the message", name, out)
+		}
+	}
+
+	sf, _ := Formatter("sarif")
+	var sl struct {
+		Runs []struct {
+			Results []struct {
+				Locations []interface{} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if unmarshalErr := json.Unmarshal([]byte(sf.Format(wrapped)), &sl); unmarshalErr != nil {
+		t.Fatalf("sarif formatter produced invalid JSON: %v", unmarshalErr)
+	}
+	if locations := sl.Runs[0].Results[0].Locations; len(locations) != 0 {
+		t.Errorf("sarif locations = %v, want none for a frameless error", locations)
+	}
+}
+
+// TestJoinErrorsWithWrappedLeaf covers the concurrent-parse scenario JoinErrors exists for:
+// one package failing on a missing subinclude (a WrapError with no frame) alongside another
+// failing normally. Rendering the joined error must show both "Traceback (i of N)" blocks
+// rather than panicking on the frameless leaf.
+func TestJoinErrorsWithWrappedLeaf(t *testing.T) {
+	wrapped := WrapError(errTest("missing subinclude"))
+	real := AddStackFrame(Position{Filename: "BUILD", Line: 1, Column: 1}, errTest("syntax error"))
+	joined := JoinErrors(wrapped, real)
+
+	for _, name := range []string{"text", "ansi", "json", "sarif"} {
+		f, ok := Formatter(name)
+		if !ok {
+			t.Fatalf("Formatter(%q) not found", name)
+		}
+		out := f.Format(joined)
+		if !strings.Contains(out, "missing subinclude") || !strings.Contains(out, "syntax error") {
+			t.Errorf("Formatter(%q).Format() = %q, want both leaves present", name, out)
+		}
+	}
+	if msg := joined.Error(); !strings.Contains(msg, "Traceback (1 of 2)") || !strings.Contains(msg, "Traceback (2 of 2)") {
+		t.Errorf("Error() = %q, want both traceback blocks", msg)
+	}
+}
+
+// TestErrorMessageRangeMultiLine exercises the multi-line underlining that failRange/
+// AddStackFrameRange exist for, by raising a genuinely multi-line Range (as a call expression
+// spanning several lines would produce once the parser threads Range through Statement/
+// Expression nodes) and checking the rendered message covers every line it spans.
+func TestErrorMessageRangeMultiLine(t *testing.T) {
+	src := "call(\n    bad,\n)\n"
+	rng := Range{
+		Start: Position{Filename: "BUILD", Line: 1, Column: 1},
+		End:   Position{Filename: "BUILD", Line: 3, Column: 2},
+	}
+
+	err := panicsWith(t, func() { failRange(rng, "bad argument") })
+	err = AddReader(err, &namedReader{r: bytes.NewReader([]byte(src)), name: "BUILD"})
+
+	var stack *errorStack
+	if !errors.As(err, &stack) {
+		t.Fatalf("failRange did not produce an *errorStack")
+	}
+	msg := stack.errorMessage(plainColorScheme)
+	if !strings.Contains(msg, "bad argument") {
+		t.Errorf("errorMessage() = %q, want it to contain the error text", msg)
+	}
+	if !strings.Contains(msg, "call(") || !strings.Contains(msg, "bad,") || !strings.Contains(msg, "\n)\n") {
+		t.Errorf("errorMessage() = %q, want it to contain every spanned line", msg)
+	}
+}
+
+// panicsWith runs fn, which is expected to panic with an error (as fail/failRange do), and
+// returns the recovered value.
+func panicsWith(t *testing.T, fn func()) (recovered error) {
+	t.Helper()
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatalf("fn did not panic")
+		}
+		err, ok := r.(error)
+		if !ok {
+			t.Fatalf("recovered value %v is not an error", r)
+		}
+		recovered = err
+	}()
+	fn()
+	return nil
+}
+
+// TestFormattersRoundTrip checks that the json and sarif formatters both produce output that
+// unmarshals back into the structures tools are expected to consume, with the error's position
+// carried through correctly.
+func TestFormattersRoundTrip(t *testing.T) {
+	err := AddStackFrame(Position{Filename: "BUILD", Line: 5, Column: 3}, errTest("bad target"))
+
+	jf, _ := Formatter("json")
+	var je struct {
+		Message  string `json:"message"`
+		Filename string `json:"filename"`
+		Line     int    `json:"line"`
+		Column   int    `json:"column"`
+	}
+	if unmarshalErr := json.Unmarshal([]byte(jf.Format(err)), &je); unmarshalErr != nil {
+		t.Fatalf("json formatter produced invalid JSON: %v", unmarshalErr)
+	}
+	if je.Filename != "BUILD" || je.Line != 5 || je.Column != 3 {
+		t.Errorf("json formatter position = %+v, want BUILD:5:3", je)
+	}
+
+	sf, _ := Formatter("sarif")
+	var sl struct {
+		Runs []struct {
+			Results []struct {
+				Locations []struct {
+					PhysicalLocation struct {
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if unmarshalErr := json.Unmarshal([]byte(sf.Format(err)), &sl); unmarshalErr != nil {
+		t.Fatalf("sarif formatter produced invalid JSON: %v", unmarshalErr)
+	}
+	if len(sl.Runs) != 1 || len(sl.Runs[0].Results) != 1 {
+		t.Fatalf("sarif formatter = %+v, want exactly one run with one result", sl)
+	}
+	region := sl.Runs[0].Results[0].Locations[0].PhysicalLocation.Region
+	if region.StartLine != 5 || region.StartColumn != 3 {
+		t.Errorf("sarif region = %+v, want line 5 column 3", region)
+	}
+}
+
+// TestErrorMessageOutOfRangeColumn ensures a column beyond the end of its line (e.g. stale
+// position info after the source file changed underneath it) falls back to the bare error
+// message instead of trying to underline a column the line doesn't have.
+func TestErrorMessageOutOfRangeColumn(t *testing.T) {
+	stack := &errorStack{
+		err:     errTest("stale position"),
+		Stack:   []Position{{Filename: "BUILD", Line: 1, Column: 100}},
+		Ends:    []Position{{}},
+		Readers: []io.ReadSeeker{bytes.NewReader([]byte("short\n"))},
+	}
+	if msg := stack.errorMessage(plainColorScheme); msg != "stale position" {
+		t.Errorf("errorMessage() = %q, want it to fall back to the bare message", msg)
+	}
+}
+
+// TestDebugTraceback checks that enabling --debug_traceback / PLZ_DEBUG_TRACEBACK makes errors
+// carry the underlying Go call stack, with runtime/defer glue filtered out, and that it's
+// surfaced both by the json formatter's GoFrames field and by the text formatter's output.
+func TestDebugTraceback(t *testing.T) {
+	SetDebugTraceback(true)
+	defer SetDebugTraceback(false)
+
+	wrapped := WrapError(errTest("something went missing"))
+
+	var stack *errorStack
+	if !errors.As(wrapped, &stack) {
+		t.Fatalf("WrapError did not return an *errorStack")
+	}
+	if len(stack.goFrames) == 0 {
+		t.Fatalf("goFrames is empty, want the capturing call stack")
+	}
+	for _, f := range stack.goFrames {
+		if isGoRuntimeGlue(f.FuncName) {
+			t.Errorf("goFrames contains runtime/defer glue frame %q, want it filtered out", f.FuncName)
+		}
+	}
+
+	jf, _ := Formatter("json")
+	var je struct {
+		GoFrames []Frame `json:"goFrames"`
+	}
+	if unmarshalErr := json.Unmarshal([]byte(jf.Format(wrapped)), &je); unmarshalErr != nil {
+		t.Fatalf("json formatter produced invalid JSON: %v", unmarshalErr)
+	}
+	if len(je.GoFrames) == 0 {
+		t.Errorf("json formatter's goFrames is empty, want it populated")
+	}
+
+	tf, _ := Formatter("text")
+	if out := tf.Format(wrapped); !strings.Contains(out, "Go call stack:") {
+		t.Errorf("text formatter output = %q, want it to include the Go call stack", out)
+	}
+}
+
+func TestIsGoRuntimeGlue(t *testing.T) {
+	cases := map[string]bool{
+		"runtime.gopanic":           true,
+		"runtime.gorecover":         true,
+		"main.main.func1":           true,
+		"main.main.funcRename":      true,
+		"please/src/parse/asp.fail": false,
+	}
+	for fn, want := range cases {
+		if got := isGoRuntimeGlue(fn); got != want {
+			t.Errorf("isGoRuntimeGlue(%q) = %v, want %v", fn, got, want)
+		}
+	}
+}
+
+type errTest string
+
+func (e errTest) Error() string { return string(e) }